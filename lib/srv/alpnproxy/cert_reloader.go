@@ -0,0 +1,184 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gravitational/trace"
+)
+
+// CertReloader is the default implementation of LocalProxyConfig's
+// GetClientCertificate/GetRootCAs hooks: it loads credentials once up
+// front, then watches watchDir with fsnotify and reloads them whenever a
+// file underneath it changes (e.g. a `tsh login` refresh or a
+// `tctl auth rotate` rewriting the CA on disk).
+//
+// A reload that fails (for example because a certificate on disk has
+// expired and hasn't been renewed yet) is logged and otherwise ignored,
+// leaving the last good credentials in place so existing and new
+// connections keep working until a subsequent filesystem event brings
+// fresher ones.
+type CertReloader struct {
+	loadCert func() (*tls.Certificate, error)
+	loadCAs  func() (*x509.CertPool, error)
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+
+	watcher   *fsnotify.Watcher
+	closeOnce sync.Once
+}
+
+// NewCertReloader creates a CertReloader watching watchDir and everything
+// beneath it. loadCert and/or loadCAs may be nil if that half of the
+// credentials doesn't need reloading (e.g. an SSH local proxy only needs
+// loadCAs).
+func NewCertReloader(watchDir string, loadCert func() (*tls.Certificate, error), loadCAs func() (*x509.CertPool, error)) (*CertReloader, error) {
+	r := &CertReloader{loadCert: loadCert, loadCAs: loadCAs}
+	if err := r.reload(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	// fsnotify only reports events for entries written directly inside a
+	// watched directory, not recursively, and tsh nests CA and cert files
+	// a few levels under the profile's keys directory. Watch every
+	// subdirectory so a rotation anywhere under watchDir is seen.
+	if err := addWatchRecursive(watcher, watchDir); err != nil {
+		watcher.Close()
+		return nil, trace.Wrap(err)
+	}
+	r.watcher = watcher
+
+	go r.watchLoop()
+	return r, nil
+}
+
+// addWatchRecursive registers watchDir and all of its subdirectories with
+// watcher. Missing directories are skipped rather than treated as fatal,
+// since a credential directory may not exist yet on first use.
+func addWatchRecursive(watcher *fsnotify.Watcher, watchDir string) error {
+	err := filepath.WalkDir(watchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return trace.Wrap(err)
+}
+
+func (r *CertReloader) watchLoop() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				log.WithError(err).Debug("Failed to reload local proxy credentials, keeping previous ones.")
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Debug("Local proxy credential watcher error.")
+		}
+	}
+}
+
+func (r *CertReloader) reload() error {
+	var cert *tls.Certificate
+	if r.loadCert != nil {
+		var err error
+		cert, err = r.loadCert()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	var pool *x509.CertPool
+	if r.loadCAs != nil {
+		var err error
+		pool, err = r.loadCAs()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loadCert != nil {
+		r.cert = cert
+	}
+	if r.loadCAs != nil {
+		r.pool = pool
+	}
+	return nil
+}
+
+// GetClientCertificate implements the LocalProxyConfig.GetClientCertificate hook.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, trace.NotFound("no client certificate loaded yet")
+	}
+	return r.cert, nil
+}
+
+// GetRootCAs implements the LocalProxyConfig.GetRootCAs hook.
+func (r *CertReloader) GetRootCAs() (*x509.CertPool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.pool == nil {
+		return nil, trace.NotFound("no CA pool loaded yet")
+	}
+	return r.pool, nil
+}
+
+// Close stops the filesystem watcher.
+func (r *CertReloader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		err = r.watcher.Close()
+	})
+	return trace.Wrap(err)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// seenCertRecorder safely records the most recent client certificate a test
+// TLS server has observed, for a goroutine-safe handoff to the test's
+// assertions.
+type seenCertRecorder struct {
+	mu   sync.Mutex
+	cert *x509.Certificate
+}
+
+func (r *seenCertRecorder) set(cert *x509.Certificate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+}
+
+func (r *seenCertRecorder) get() *x509.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+// writeCertKeyPair PEM-encodes cert into dir/cert.pem and dir/key.pem,
+// returning their paths.
+func writeCertKeyPair(t *testing.T, dir string, cert tls.Certificate) (certPath, keyPath string) {
+	t.Helper()
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	require.NoError(t, os.WriteFile(certPath, certPEM, 0600))
+
+	rsaKey, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	require.True(t, ok)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+
+	return certPath, keyPath
+}
+
+func TestCertReloaderPicksUpRotatedClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certA := selfSignedTestCert(t)
+	certPath, keyPath := writeCertKeyPair(t, dir, certA)
+
+	reloader, err := NewCertReloader(dir, func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		return &cert, err
+	}, nil)
+	require.NoError(t, err)
+	defer reloader.Close()
+
+	got, err := reloader.GetClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, certA.Certificate[0], got.Certificate[0])
+
+	certB := selfSignedTestCert(t)
+	writeCertKeyPair(t, dir, certB)
+
+	require.Eventually(t, func() bool {
+		got, err := reloader.GetClientCertificate(nil)
+		return err == nil && string(got.Certificate[0]) == string(certB.Certificate[0])
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLocalProxyHotReloadsClientCertificateMidFlight(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certA := selfSignedTestCert(t)
+	certPath, keyPath := writeCertKeyPair(t, dir, certA)
+
+	var seenCert seenCertRecorder
+	upstream := tlsServerRecordingClientCert(t, &seenCert)
+
+	reloader, err := NewCertReloader(dir, func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		return &cert, err
+	}, nil)
+	require.NoError(t, err)
+	defer reloader.Close()
+
+	lp, err := NewLocalProxy(LocalProxyConfig{
+		RemoteProxyAddr:      upstream,
+		Protocol:             "teleport-postgres",
+		InsecureSkipVerify:   true,
+		GetClientCertificate: reloader.GetClientCertificate,
+	})
+	require.NoError(t, err)
+	defer lp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := lp.dialUpstream(ctx)
+	require.NoError(t, err)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		got := seenCert.get()
+		return got != nil && string(got.Raw) == string(certA.Certificate[0])
+	}, 5*time.Second, 20*time.Millisecond)
+
+	certB := selfSignedTestCert(t)
+	writeCertKeyPair(t, dir, certB)
+
+	require.Eventually(t, func() bool {
+		conn, err := lp.dialUpstream(ctx)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		got := seenCert.get()
+		return got != nil && string(got.Raw) != string(certA.Certificate[0])
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// tlsServerRecordingClientCert starts a mutual-TLS server that records the
+// client certificate presented on each connection into seen.
+func tlsServerRecordingClientCert(t *testing.T, seen *seenCertRecorder) string {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedTestCert(t)},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tlsConn, ok := c.(*tls.Conn)
+				if !ok {
+					return
+				}
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				state := tlsConn.ConnectionState()
+				if len(state.PeerCertificates) > 0 {
+					seen.set(state.PeerCertificates[0])
+				}
+			}(c)
+		}
+	}()
+
+	return listener.Addr().String()
+}
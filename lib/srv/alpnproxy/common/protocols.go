@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package common holds the ALPN protocol identifiers shared between the
+// Teleport web proxy and local proxy client implementations.
+package common
+
+import "github.com/gravitational/trace"
+
+// Protocol is a TLS ALPN protocol identifier used to route a connection
+// arriving at the Teleport web proxy to the correct backend service.
+type Protocol string
+
+const (
+	// ProtocolHTTP is used to route HTTP/HTTPS traffic to an application.
+	ProtocolHTTP Protocol = "teleport-http"
+	// ProtocolProxySSH is used to route SSH traffic through the web proxy.
+	ProtocolProxySSH Protocol = "teleport-proxy-ssh"
+	// ProtocolPostgres is used to route PostgreSQL client traffic.
+	ProtocolPostgres Protocol = "teleport-postgres"
+	// ProtocolMySQL is used to route MySQL client traffic.
+	ProtocolMySQL Protocol = "teleport-mysql"
+	// ProtocolMongoDB is used to route MongoDB client traffic.
+	ProtocolMongoDB Protocol = "teleport-mongodb"
+)
+
+// dbProtocolToALPN maps a database "protocol" (as used in the database
+// resource spec) to its corresponding ALPN protocol.
+var dbProtocolToALPN = map[string]Protocol{
+	"postgres": ProtocolPostgres,
+	"mysql":    ProtocolMySQL,
+	"mongodb":  ProtocolMongoDB,
+}
+
+// ToALPNProtocol maps a database protocol name to the ALPN protocol used to
+// route connections for that database through the Teleport web proxy.
+func ToALPNProtocol(dbProtocol string) (Protocol, error) {
+	protocol, ok := dbProtocolToALPN[dbProtocol]
+	if !ok {
+		return "", trace.BadParameter("unsupported database protocol %q", dbProtocol)
+	}
+	return protocol, nil
+}
@@ -0,0 +1,335 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package alpnproxy implements a local TLS proxy used by tsh to tunnel
+// SSH, database and application traffic to a Teleport web proxy that has
+// ALPN connection routing (TLS Routing) enabled.
+package alpnproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/gravitational/trace"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	alpncommon "github.com/gravitational/teleport/lib/srv/alpnproxy/common"
+)
+
+var log = logrus.WithField("component", "local_proxy")
+
+// ContextDialer dials a network address, optionally honoring ctx
+// cancellation. It is satisfied by *net.Dialer as well as the HTTP CONNECT
+// and SOCKS5 proxy dialers returned by NewProxyDialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// LocalProxyConfig is the configuration for a LocalProxy.
+type LocalProxyConfig struct {
+	// RemoteProxyAddr is the host:port of the Teleport web proxy to connect to.
+	RemoteProxyAddr string
+	// Protocol is the ALPN protocol used to route the connection to the
+	// correct backend once it reaches the web proxy.
+	Protocol alpncommon.Protocol
+	// InsecureSkipVerify turns off verification of the web proxy's TLS certificate.
+	InsecureSkipVerify bool
+	// Listener, if set, is used to accept local connections instead of
+	// having the LocalProxy open its own.
+	Listener net.Listener
+	// SNI is the server name sent in the TLS ClientHello to the web proxy.
+	SNI string
+	// Certs are the client certificates presented to the web proxy.
+	Certs []tls.Certificate
+	// ClientTLSConfig, if set, overrides the TLS config used to dial the
+	// web proxy. Certs are ignored when this is set; SNI, Protocol and
+	// InsecureSkipVerify are still applied on top of a copy of it.
+	ClientTLSConfig *tls.Config
+	// ParentContext is the context SSHProxy uses to dial the web proxy.
+	ParentContext context.Context
+	// ProxyDialer, if set, is used to establish the underlying TCP
+	// connection to RemoteProxyAddr, routing it through an upstream
+	// HTTP CONNECT or SOCKS5 proxy. When nil, a plain net.Dialer is used.
+	ProxyDialer ContextDialer
+
+	// GetClientCertificate, if set, is consulted on every upstream dial to
+	// obtain the client certificate to present to the web proxy, instead of
+	// the static Certs field. This lets a long-running LocalProxy pick up a
+	// renewed certificate (e.g. after `tsh login`) without restarting.
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	// GetRootCAs, if set, is consulted on every upstream dial to obtain the
+	// CA pool used to verify the web proxy's certificate, instead of a
+	// pool captured once at startup. This lets a long-running LocalProxy
+	// pick up a `tctl auth rotate` without restarting.
+	GetRootCAs func() (*x509.CertPool, error)
+
+	// RouteBySNI, if set, turns the LocalProxy into a single-port SNI
+	// router: incoming TLS connections are terminated locally using a
+	// short-lived per-resource certificate, then forwarded upstream using
+	// the LocalProxyConfig keyed by the resource name encoded in the SNI
+	// the client requested (see RouteBySNIHost). RemoteProxyAddr and
+	// Protocol are ignored on the top-level config in this mode; each
+	// entry supplies its own.
+	RouteBySNI map[string]LocalProxyConfig
+
+	// MITM, if set, turns this LocalProxy into a transparent HTTPS-terminating
+	// MITM (see --inspect on `tsh proxy app`) instead of passing bytes through
+	// untouched.
+	MITM *MITMConfig
+
+	// SSHUser is the OS user to log in as when proxying an SSH connection.
+	SSHUser string
+	// SSHUserHost is the host:port of the SSH target, as understood by the
+	// Teleport web proxy ("teleport-proxy-ssh" ALPN protocol).
+	SSHUserHost string
+	// SSHHostKeyCallback is used to validate the host key presented by the target node.
+	SSHHostKeyCallback ssh.HostKeyCallback
+	// SSHTrustedCluster, if set, is the name of the trusted cluster the target node belongs to.
+	SSHTrustedCluster string
+}
+
+// CheckAndSetDefaults verifies the configuration and sets default values.
+func (c *LocalProxyConfig) CheckAndSetDefaults() error {
+	if len(c.RouteBySNI) == 0 {
+		if c.RemoteProxyAddr == "" {
+			return trace.BadParameter("missing remote proxy address")
+		}
+		if c.Protocol == "" {
+			return trace.BadParameter("missing ALPN protocol")
+		}
+	}
+	if c.ParentContext == nil {
+		c.ParentContext = context.Background()
+	}
+	if c.ProxyDialer == nil {
+		c.ProxyDialer = &net.Dialer{}
+	}
+	for name, routeCfg := range c.RouteBySNI {
+		if err := routeCfg.CheckAndSetDefaults(); err != nil {
+			return trace.Wrap(err)
+		}
+		c.RouteBySNI[name] = routeCfg
+	}
+	return nil
+}
+
+// LocalProxy is a local TLS proxy that forwards connections accepted on a
+// local listener to a Teleport web proxy, negotiating the given ALPN
+// protocol so the connection is routed to the correct backend service.
+type LocalProxy struct {
+	cfg      LocalProxyConfig
+	listener net.Listener
+
+	closeOnce sync.Once
+}
+
+// NewLocalProxy creates a new LocalProxy from the given configuration.
+func NewLocalProxy(cfg LocalProxyConfig) (*LocalProxy, error) {
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	listener := cfg.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
+	return &LocalProxy{
+		cfg:      cfg,
+		listener: listener,
+	}, nil
+}
+
+// GetAddr returns the address the local proxy is listening on.
+func (l *LocalProxy) GetAddr() string {
+	return l.listener.Addr().String()
+}
+
+// Close closes the local proxy's listener.
+func (l *LocalProxy) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.listener.Close()
+	})
+	return trace.Wrap(err)
+}
+
+// Start accepts connections on the local listener and forwards each one to
+// the remote Teleport web proxy until ctx is canceled or the listener is closed.
+// If cfg.RouteBySNI is set, Start instead runs the single-port SNI router
+// (see startSNIRouter).
+func (l *LocalProxy) Start(ctx context.Context) error {
+	if len(l.cfg.RouteBySNI) > 0 {
+		return trace.Wrap(l.startSNIRouter(ctx))
+	}
+	if l.cfg.MITM != nil {
+		return trace.Wrap(l.startMITMProxy(ctx))
+	}
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		go func() {
+			if err := l.handleDownstreamConnection(ctx, conn); err != nil && ctx.Err() == nil {
+				log.WithError(err).Debug("Failed to handle local proxy connection.")
+			}
+		}()
+	}
+}
+
+// handleDownstreamConnection dials the remote web proxy and copies data
+// bidirectionally between the local downstream connection and the upstream
+// TLS connection.
+func (l *LocalProxy) handleDownstreamConnection(ctx context.Context, downstreamConn net.Conn) error {
+	defer downstreamConn.Close()
+
+	upstreamConn, err := l.dialUpstream(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer upstreamConn.Close()
+
+	errC := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstreamConn, downstreamConn)
+		errC <- err
+	}()
+	go func() {
+		_, err := io.Copy(downstreamConn, upstreamConn)
+		errC <- err
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		if err := <-errC; err != nil && err != io.EOF {
+			errs = append(errs, err)
+		}
+	}
+	return trace.NewAggregate(errs...)
+}
+
+// dialUpstream opens the underlying TCP connection to RemoteProxyAddr
+// (optionally through cfg.ProxyDialer) and performs the TLS+ALPN handshake
+// with the Teleport web proxy.
+func (l *LocalProxy) dialUpstream(ctx context.Context) (*tls.Conn, error) {
+	return dialUpstreamTLS(ctx, l.cfg)
+}
+
+// dialUpstreamTLS opens the underlying TCP connection to cfg.RemoteProxyAddr
+// (optionally through cfg.ProxyDialer) and performs the TLS+ALPN handshake
+// with the Teleport web proxy described by cfg.
+func dialUpstreamTLS(ctx context.Context, cfg LocalProxyConfig) (*tls.Conn, error) {
+	rawConn, err := cfg.ProxyDialer.DialContext(ctx, "tcp", cfg.RemoteProxyAddr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	tlsConfig, err := upstreamTLSConfig(cfg)
+	if err != nil {
+		rawConn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	tlsConn := tls.Client(rawConn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, trace.Wrap(err)
+	}
+	return tlsConn, nil
+}
+
+// upstreamTLSConfig builds the TLS client config used to dial the web proxy,
+// rebuilt fresh on every call so cfg.GetClientCertificate / cfg.GetRootCAs
+// (if set) can serve certificates or CAs reloaded since the last dial.
+func upstreamTLSConfig(cfg LocalProxyConfig) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if cfg.ClientTLSConfig != nil {
+		tlsConfig = cfg.ClientTLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{Certificates: cfg.Certs}
+	}
+	tlsConfig.NextProtos = []string{string(cfg.Protocol)}
+	tlsConfig.ServerName = cfg.SNI
+	tlsConfig.InsecureSkipVerify = tlsConfig.InsecureSkipVerify || cfg.InsecureSkipVerify
+
+	if cfg.GetClientCertificate != nil {
+		tlsConfig.GetClientCertificate = cfg.GetClientCertificate
+	}
+	if cfg.GetRootCAs != nil {
+		pool, err := cfg.GetRootCAs()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// SSHProxy dials the web proxy with the "teleport-proxy-ssh" ALPN protocol
+// and proxies an interactive SSH session to the configured SSHUserHost,
+// authenticating with keys held in agt.
+func (l *LocalProxy) SSHProxy(agt agent.Agent) error {
+	upstreamConn, err := l.dialUpstream(l.cfg.ParentContext)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer upstreamConn.Close()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            l.cfg.SSHUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agt.Signers)},
+		HostKeyCallback: l.cfg.SSHHostKeyCallback,
+	}
+
+	sconn, chans, reqs, err := ssh.NewClientConn(upstreamConn, l.cfg.SSHUserHost, clientConfig)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	client := ssh.NewClient(sconn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer session.Close()
+
+	return trace.Wrap(runInteractiveSession(session))
+}
+
+// runInteractiveSession wires the session's stdio to the local terminal and
+// blocks until the remote command exits.
+func runInteractiveSession(session *ssh.Session) error {
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	return trace.Wrap(session.Run(""))
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// mitmCAValidity is how long the root CA generated for --inspect mode is
+// valid for. It is written to disk and reused across tsh invocations so the
+// user only has to trust it once.
+const mitmCAValidity = 10 * 365 * 24 * time.Hour
+
+// mitmLeafValidity is how long a leaf certificate minted for a given host is
+// cached and considered valid for, following the pattern used by Hetty's
+// CertConfig.
+const mitmLeafValidity = 24 * time.Hour
+
+// MITMCertConfig loads (or generates, on first use) a local root CA and uses
+// it to mint short-lived leaf certificates on demand, one per SNI host, so a
+// LocalProxy can transparently terminate TLS for --inspect mode.
+type MITMCertConfig struct {
+	caCert    *x509.Certificate
+	caKey     *rsa.PrivateKey
+	caRawCert tls.Certificate
+
+	mu    sync.Mutex
+	certs map[string]cachedCert
+}
+
+type cachedCert struct {
+	cert      *tls.Certificate
+	expiresAt time.Time
+}
+
+// NewMITMCertConfig loads the CA key pair from caCertPath/caKeyPath, or
+// generates and persists a new one if the files do not exist yet.
+func NewMITMCertConfig(caCertPath, caKeyPath string) (*MITMCertConfig, error) {
+	if _, err := os.Stat(caCertPath); err == nil {
+		return loadMITMCertConfig(caCertPath, caKeyPath)
+	}
+	return generateMITMCertConfig(caCertPath, caKeyPath)
+}
+
+func loadMITMCertConfig(caCertPath, caKeyPath string) (*MITMCertConfig, error) {
+	certPEM, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	keyPEM, err := os.ReadFile(caKeyPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	rawCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caCert, err := x509.ParseCertificate(rawCert.Certificate[0])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caKey, ok := rawCert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, trace.BadParameter("CA private key at %s is not RSA", caKeyPath)
+	}
+	return &MITMCertConfig{
+		caCert:    caCert,
+		caKey:     caKey,
+		caRawCert: rawCert,
+		certs:     make(map[string]cachedCert),
+	}, nil
+}
+
+func generateMITMCertConfig(caCertPath, caKeyPath string) (*MITMCertConfig, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "tsh proxy app --inspect local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(mitmCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(caCertPath), 0700); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(caCertPath, certPEM, 0600); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := os.WriteFile(caKeyPath, keyPEM, 0600); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &MITMCertConfig{
+		caCert:    caCert,
+		caKey:     key,
+		caRawCert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		certs:     make(map[string]cachedCert),
+	}, nil
+}
+
+// CACertPEM returns the PEM-encoded CA certificate, for printing install
+// instructions to the user.
+func (c *MITMCertConfig) CACertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.caRawCert.Certificate[0]})
+}
+
+// CertFor returns a leaf certificate for host, minting and caching a fresh
+// one if none is cached or the cached one has expired.
+func (c *MITMCertConfig) CertFor(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.certs[host]; ok && time.Now().Before(cached.expiresAt) {
+		return cached.cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	notAfter := time.Now().Add(mitmLeafValidity)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.caCert, &leafKey.PublicKey, c.caKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, c.caRawCert.Certificate[0]},
+		PrivateKey:  leafKey,
+	}
+	c.certs[host] = cachedCert{cert: cert, expiresAt: notAfter}
+	return cert, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// harDocument is a minimal subset of the HAR 1.2 schema, just enough to
+// capture the request/response pairs seen by --inspect mode. Request and
+// response bodies are stored as plain strings under postData/content rather
+// than as HAR's structured postData/content objects.
+type harDocument struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name string `json:"name"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+}
+
+type harRequest struct {
+	Method  string     `json:"method"`
+	URL     string     `json:"url"`
+	Headers []harPair  `json:"headers"`
+	Body    string     `json:"postData,omitempty"`
+}
+
+type harResponse struct {
+	Status  int       `json:"status"`
+	Headers []harPair `json:"headers"`
+	Body    string    `json:"content,omitempty"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// redactHeaders returns a copy of h with any header in
+// defaultRedactedHeaders replaced by a fixed placeholder.
+func redactHeaders(h http.Header) http.Header {
+	redacted := h.Clone()
+	for name := range redacted {
+		if defaultRedactedHeaders[http.CanonicalHeaderKey(name)] {
+			redacted.Set(name, "[REDACTED]")
+		}
+	}
+	return redacted
+}
+
+func headersToPairs(h http.Header) []harPair {
+	pairs := make([]harPair, 0, len(h))
+	for name, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, harPair{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// cappedBuffer accumulates up to maxSize bytes written to it and silently
+// drops anything beyond that, so tee-ing a body through one for logging
+// purposes never grows unbounded no matter how large the real body is.
+// maxSize <= 0 applies a 1MiB default.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	maxSize int64
+}
+
+func newCappedBuffer(maxSize int64) *cappedBuffer {
+	if maxSize <= 0 {
+		maxSize = 1 << 20 // 1MiB default cap
+	}
+	return &cappedBuffer{maxSize: maxSize}
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := c.maxSize - int64(c.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			p = p[:room]
+		}
+		c.buf.Write(p)
+	}
+	return n, nil
+}
+
+func (c *cappedBuffer) Bytes() []byte {
+	return c.buf.Bytes()
+}
+
+// teeBody wraps body in a TeeReader that also copies every byte read into
+// cap, so whatever forwards body downstream/upstream still sees the
+// complete, untruncated stream while up to cap's capacity is captured for
+// logging. Returns body unchanged if there's nothing to tap.
+func teeBody(body io.ReadCloser, noBody bool, cap *cappedBuffer) io.ReadCloser {
+	if body == nil || noBody {
+		return body
+	}
+	return &teeReadCloser{Reader: io.TeeReader(body, cap), Closer: body}
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writeLine writes a single human-readable summary of entry to l.cfg.Out.
+func (l *RequestLogger) writeLine(entry harEntry) {
+	if l.cfg.Out == nil {
+		return
+	}
+	fmt.Fprintf(l.cfg.Out, "%s %s -> %d (%dms)\n", entry.Request.Method, entry.Request.URL, entry.Response.Status, entry.Time)
+}
+
+func createFile(path string) (*os.File, error) {
+	return os.Create(path)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// defaultRedactedHeaders are stripped from logged requests unless the caller
+// opts out, since they routinely carry credentials.
+var defaultRedactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+}
+
+// RequestLoggerConfig configures a RequestLogger.
+type RequestLoggerConfig struct {
+	// Out receives one human-readable line per captured exchange. Ignored
+	// once HARPath is set.
+	Out io.Writer
+	// HARPath, if set, makes the logger buffer every exchange and write a
+	// single HAR 1.2 document to this path on Close instead of logging to Out.
+	HARPath string
+	// NoBody omits request/response bodies from the captured log entirely.
+	NoBody bool
+	// MaxBodySize caps how many bytes of a body are captured; 0 or less
+	// applies a 1MiB default cap.
+	MaxBodySize int64
+}
+
+// RequestLogger captures HTTP exchanges seen by a LocalProxy running in
+// --inspect mode, redacting sensitive headers by default.
+type RequestLogger struct {
+	cfg RequestLoggerConfig
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// NewRequestLogger creates a RequestLogger from the given configuration.
+func NewRequestLogger(cfg RequestLoggerConfig) *RequestLogger {
+	return &RequestLogger{cfg: cfg}
+}
+
+// capturedExchange is an in-flight request/response pair being assembled by
+// LogRequest/LogResponse.
+type capturedExchange struct {
+	method     string
+	url        string
+	reqHeaders http.Header
+	reqBodyCap *cappedBuffer
+	startedAt  time.Time
+	logger     *RequestLogger
+}
+
+// LogRequest snapshots req's method, URL and headers (redacting sensitive
+// ones) and, unless NoBody is set, taps its body through a capped buffer so
+// whatever forwards the request upstream still sees the complete,
+// untruncated stream while up to MaxBodySize bytes are captured alongside
+// it. Returns a handle to pass to LogResponse once the upstream response is
+// known.
+func (l *RequestLogger) LogRequest(req *http.Request) *capturedExchange {
+	reqBodyCap := newCappedBuffer(l.cfg.MaxBodySize)
+	req.Body = teeBody(req.Body, l.cfg.NoBody, reqBodyCap)
+
+	return &capturedExchange{
+		method:     req.Method,
+		url:        req.URL.String(),
+		reqHeaders: redactHeaders(req.Header),
+		reqBodyCap: reqBodyCap,
+		startedAt:  time.Now(),
+		logger:     l,
+	}
+}
+
+// LogResponse taps resp's body the same way LogRequest taps a request body,
+// and arranges for the exchange to be logged to Out or buffered for the
+// eventual HAR document once the body has actually been read by whatever
+// forwards it downstream -- the response body isn't drained yet when
+// LogResponse returns, so the entry can't be built until then. The caller
+// must close resp.Body (even on an error path) or the exchange will never
+// be logged.
+func (l *RequestLogger) LogResponse(ex *capturedExchange, resp *http.Response) {
+	elapsed := time.Since(ex.startedAt)
+	if resp.Body == nil {
+		l.finish(ex, elapsed, resp.StatusCode, redactHeaders(resp.Header), newCappedBuffer(l.cfg.MaxBodySize))
+		return
+	}
+
+	respBodyCap := newCappedBuffer(l.cfg.MaxBodySize)
+	status, headers := resp.StatusCode, redactHeaders(resp.Header)
+	resp.Body = &onCloseBody{
+		ReadCloser: teeBody(resp.Body, l.cfg.NoBody, respBodyCap),
+		onClose: func() {
+			l.finish(ex, elapsed, status, headers, respBodyCap)
+		},
+	}
+}
+
+// finish builds the HAR entry for a completed exchange and logs or buffers
+// it. It must only run once the response body has actually been read, since
+// respBodyCap is filled by the tee installed in LogResponse as the
+// forwarded copy is read, not up front. elapsed is measured up to the
+// response being received rather than to this call, since draining and
+// forwarding the body downstream is the caller's work, not the upstream
+// round trip being logged.
+func (l *RequestLogger) finish(ex *capturedExchange, elapsed time.Duration, status int, respHeaders http.Header, respBodyCap *cappedBuffer) {
+	entry := harEntry{
+		StartedDateTime: ex.startedAt.UTC().Format(time.RFC3339),
+		Time:            elapsed.Milliseconds(),
+		Request: harRequest{
+			Method:  ex.method,
+			URL:     ex.url,
+			Headers: headersToPairs(ex.reqHeaders),
+			Body:    string(ex.reqBodyCap.Bytes()),
+		},
+		Response: harResponse{
+			Status:  status,
+			Headers: headersToPairs(respHeaders),
+			Body:    string(respBodyCap.Bytes()),
+		},
+	}
+
+	if l.cfg.HARPath != "" {
+		l.mu.Lock()
+		l.entries = append(l.entries, entry)
+		l.mu.Unlock()
+		return
+	}
+
+	l.writeLine(entry)
+}
+
+// onCloseBody runs onClose once the wrapped body is closed, after the close
+// itself completes.
+type onCloseBody struct {
+	io.ReadCloser
+	onClose func()
+	once    sync.Once
+}
+
+func (b *onCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
+
+// Close flushes a buffered HAR document to disk, if HARPath was set.
+func (l *RequestLogger) Close() error {
+	if l.cfg.HARPath == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	doc := harDocument{}
+	doc.Log.Version = "1.2"
+	doc.Log.Creator.Name = "tsh proxy app --inspect"
+	doc.Log.Entries = l.entries
+
+	f, err := createFile(l.cfg.HARPath)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return trace.Wrap(enc.Encode(doc))
+}
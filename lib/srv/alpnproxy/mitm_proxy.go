@@ -0,0 +1,130 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gravitational/trace"
+)
+
+// MITMConfig turns a LocalProxy into a transparent HTTPS-terminating MITM:
+// TLS is terminated locally using a leaf certificate minted by CertConfig,
+// every request/response is captured by Logger, and the request is then
+// re-originated upstream over a fresh TLS+ALPN connection to the Teleport
+// web proxy.
+type MITMConfig struct {
+	// CertConfig mints the per-host leaf certificates used to terminate TLS locally.
+	CertConfig *MITMCertConfig
+	// Logger captures each request/response pair.
+	Logger *RequestLogger
+}
+
+// startMITMProxy runs the accept loop for --inspect mode.
+func (l *LocalProxy) startMITMProxy(ctx context.Context) error {
+	tlsListener := tls.NewListener(l.listener, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return l.cfg.MITM.CertConfig.CertFor(hello.ServerName)
+		},
+	})
+
+	for {
+		conn, err := tlsListener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		go func() {
+			if err := l.handleMITMConnection(ctx, conn); err != nil && ctx.Err() == nil {
+				log.WithError(err).Debug("Failed to handle inspected local proxy connection.")
+			}
+		}()
+	}
+}
+
+// handleMITMConnection reads one or more HTTP requests off downstreamConn,
+// logs and forwards each to the Teleport web proxy, and relays the response back.
+func (l *LocalProxy) handleMITMConnection(ctx context.Context, downstreamConn net.Conn) error {
+	defer downstreamConn.Close()
+
+	reader := bufio.NewReader(downstreamConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+
+		exchange := l.cfg.MITM.Logger.LogRequest(req)
+
+		resp, err := l.roundTripUpstream(ctx, req)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		l.cfg.MITM.Logger.LogResponse(exchange, resp)
+
+		if err := resp.Write(downstreamConn); err != nil {
+			resp.Body.Close()
+			return trace.Wrap(err)
+		}
+		resp.Body.Close()
+
+		if req.Close {
+			return nil
+		}
+	}
+}
+
+// roundTripUpstream opens a fresh TLS+ALPN connection to the Teleport web
+// proxy and sends req over it, returning the parsed response.
+func (l *LocalProxy) roundTripUpstream(ctx context.Context, req *http.Request) (*http.Response, error) {
+	upstreamConn, err := l.dialUpstream(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := req.Write(upstreamConn); err != nil {
+		upstreamConn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(upstreamConn), req)
+	if err != nil {
+		upstreamConn.Close()
+		return nil, trace.Wrap(err)
+	}
+	// The caller drains and closes the response body once it's done
+	// forwarding it downstream, so tie the upstream connection's lifetime to
+	// that close instead of closing it here, which would race the read.
+	resp.Body = &onCloseBody{
+		ReadCloser: resp.Body,
+		onClose:    func() { upstreamConn.Close() },
+	}
+	return resp, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newMITMBackend starts an httptest TLS server that, unlike
+// httptest.NewTLSServer, negotiates the "teleport-http" ALPN protocol the
+// MITM local proxy requests when dialing it -- httptest.NewTLSServer hard-codes
+// NextProtos to ["http/1.1"], which the handshake below would otherwise reject.
+func newMITMBackend(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewUnstartedServer(handler)
+	backend.TLS = &tls.Config{NextProtos: []string{"teleport-http", "http/1.1"}}
+	backend.StartTLS()
+	return backend
+}
+
+func newMITMLocalProxy(t *testing.T, upstreamAddr string, logger *RequestLogger) *LocalProxy {
+	t.Helper()
+
+	certConfig, err := NewMITMCertConfig(
+		filepath.Join(t.TempDir(), "ca.crt"),
+		filepath.Join(t.TempDir(), "ca.key"),
+	)
+	require.NoError(t, err)
+
+	lp, err := NewLocalProxy(LocalProxyConfig{
+		RemoteProxyAddr:    upstreamAddr,
+		Protocol:           "teleport-http",
+		InsecureSkipVerify: true,
+		MITM: &MITMConfig{
+			CertConfig: certConfig,
+			Logger:     logger,
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { lp.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go lp.Start(ctx)
+
+	return lp
+}
+
+func newInspectingClient(t *testing.T, lp *LocalProxy) *http.Client {
+	t.Helper()
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialer := &net.Dialer{Timeout: 5 * time.Second}
+				return tls.DialWithDialer(dialer, "tcp", lp.GetAddr(), &tls.Config{InsecureSkipVerify: true})
+			},
+		},
+	}
+}
+
+func TestMITMCapturesExchange(t *testing.T) {
+	t.Parallel()
+
+	backend := newMITMBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "secret-token", r.Header.Get("Authorization"))
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello from backend"))
+	}))
+	defer backend.Close()
+
+	var out bytes.Buffer
+	logger := NewRequestLogger(RequestLoggerConfig{Out: &out})
+	lp := newMITMLocalProxy(t, backend.Listener.Addr().String(), logger)
+
+	client := newInspectingClient(t, lp)
+	req, err := http.NewRequest(http.MethodGet, "https://app.example.com/hello", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "secret-token")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+	require.Contains(t, out.String(), "GET https://app.example.com/hello -> 418")
+}
+
+func TestMITMRedactsAuthorizationHeader(t *testing.T) {
+	t.Parallel()
+
+	backend := newMITMBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	harPath := filepath.Join(t.TempDir(), "capture.har")
+	logger := NewRequestLogger(RequestLoggerConfig{HARPath: harPath})
+	lp := newMITMLocalProxy(t, backend.Listener.Addr().String(), logger)
+
+	client := newInspectingClient(t, lp)
+	req, err := http.NewRequest(http.MethodGet, "https://app.example.com/secret", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "do-not-leak")
+	req.Header.Set("Cookie", "session=do-not-leak")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.NoError(t, logger.Close())
+
+	data, err := os.ReadFile(harPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "do-not-leak")
+	require.Contains(t, string(data), "[REDACTED]")
+}
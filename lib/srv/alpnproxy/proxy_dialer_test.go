@@ -0,0 +1,382 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startCONNECTProxy starts an in-process HTTP CONNECT proxy (à la go-git's
+// HTTP proxy tests) that tunnels to whatever host:port the client asks for.
+// If wantUser/wantPass are non-empty, the proxy requires matching basic auth.
+func startCONNECTProxy(t *testing.T, wantUser, wantPass string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleCONNECT(t, conn, wantUser, wantPass)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func handleCONNECT(t *testing.T, clientConn net.Conn, wantUser, wantPass string) {
+	defer clientConn.Close()
+
+	reader := bufio.NewReader(clientConn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	if wantUser != "" {
+		user, pass, ok := proxyBasicAuth(req)
+		if !ok || user != wantUser || pass != wantPass {
+			clientConn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+	}
+
+	targetConn, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer targetConn.Close()
+
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	errC := make(chan error, 2)
+	go func() { _, err := io.Copy(targetConn, reader); errC <- err }()
+	go func() { _, err := io.Copy(clientConn, targetConn); errC <- err }()
+	<-errC
+}
+
+// proxyBasicAuth parses basic auth credentials off req's Proxy-Authorization
+// header, the one httpConnectDialer actually sends -- unlike
+// http.Request.BasicAuth, which only ever looks at Authorization.
+func proxyBasicAuth(req *http.Request) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	user, pass, ok = strings.Cut(string(decoded), ":")
+	return user, pass, ok
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	t.Parallel()
+
+	backend := newEchoServer(t)
+	proxyAddr := startCONNECTProxy(t, "alice", "secret")
+
+	t.Run("without credentials is rejected", func(t *testing.T) {
+		dialer, err := NewProxyDialer(&url.URL{Scheme: "http", Host: proxyAddr})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = dialer.DialContext(ctx, "tcp", backend)
+		require.Error(t, err)
+	})
+
+	t.Run("with credentials tunnels traffic", func(t *testing.T) {
+		dialer, err := NewProxyDialer(&url.URL{Scheme: "http", Host: proxyAddr, User: url.UserPassword("alice", "secret")})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := dialer.DialContext(ctx, "tcp", backend)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		requireEcho(t, conn)
+	})
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	t.Parallel()
+
+	backend := newEchoServer(t)
+	proxyAddr := startSOCKS5Proxy(t)
+
+	dialer, err := NewProxyDialer(&url.URL{Scheme: "socks5", Host: proxyAddr})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", backend)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	requireEcho(t, conn)
+}
+
+func TestLocalProxyALPNThroughProxyDialer(t *testing.T) {
+	t.Parallel()
+
+	var negotiated string
+	upstream, handshakeDone := newALPNTestServer(t, []string{"teleport-postgres"}, &negotiated)
+	proxyAddr := startCONNECTProxy(t, "", "")
+
+	dialer, err := NewProxyDialer(&url.URL{Scheme: "http", Host: proxyAddr})
+	require.NoError(t, err)
+
+	lp, err := NewLocalProxy(LocalProxyConfig{
+		RemoteProxyAddr:    upstream,
+		Protocol:           "teleport-postgres",
+		InsecureSkipVerify: true,
+		ProxyDialer:        dialer,
+	})
+	require.NoError(t, err)
+	defer lp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := lp.dialUpstream(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	select {
+	case <-handshakeDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for server-side handshake to complete")
+	}
+
+	require.Equal(t, "teleport-postgres", negotiated)
+}
+
+// newEchoServer starts a plain TCP server that echoes back anything written to it.
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func requireEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+// newALPNTestServer starts a TLS server offering the given ALPN protocols and
+// records whichever one the client negotiated into *negotiated, closing the
+// returned channel once that's done. The client's Handshake/HandshakeContext
+// call can return before the server has finished processing the client's
+// Finished message, so callers must wait on the channel before reading
+// *negotiated rather than reading it right after dialing.
+func newALPNTestServer(t *testing.T, protos []string, negotiated *string) (string, <-chan struct{}) {
+	t.Helper()
+
+	cert := selfSignedTestCert(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   protos,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			return
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		*negotiated = tlsConn.ConnectionState().NegotiatedProtocol
+	}()
+
+	return listener.Addr().String(), done
+}
+
+// startSOCKS5Proxy starts a minimal no-auth SOCKS5 server handling CONNECT
+// requests, enough to exercise the client-side dialer.
+func startSOCKS5Proxy(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleSOCKS5(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, nmethods, methods...
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	// No authentication required.
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return
+	}
+
+	// Request: version, cmd, rsv, atyp
+	reqHead := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reqHead); err != nil {
+		return
+	}
+
+	var host string
+	switch reqHead[3] {
+	case 0x01: // IPv4
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		host = net.IP(addr).String()
+	case 0x03: // domain name
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return
+	}
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	errC := make(chan error, 2)
+	go func() { _, err := io.Copy(target, conn); errC <- err }()
+	go func() { _, err := io.Copy(conn, target); errC <- err }()
+	<-errC
+}
+
+// selfSignedTestCert returns an ephemeral self-signed certificate valid for
+// "127.0.0.1", for use by in-process TLS test servers.
+func selfSignedTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// localTeleportDomain is the SNI suffix used to address a resource routed by
+// the single-port SNI router, e.g. "postgres-prod.local.teleport".
+const localTeleportDomain = ".local.teleport"
+
+// RouteBySNIHost returns the local hostname a client should dial (as the TLS
+// SNI / HTTP Host) to reach the resource named name through a single-port
+// SNI router started with LocalProxyConfig.RouteBySNI.
+func RouteBySNIHost(name string) string {
+	return name + localTeleportDomain
+}
+
+// startSNIRouter runs the accept loop for a single-port SNI-multiplexed
+// proxy: the local listener terminates TLS using a certificate minted for
+// whatever SNI the client requested, then the connection is forwarded to
+// the matching upstream LocalProxyConfig in cfg.RouteBySNI.
+func (l *LocalProxy) startSNIRouter(ctx context.Context) error {
+	ca, err := newLocalCA()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	tlsListener := tls.NewListener(l.listener, &tls.Config{
+		GetCertificate: ca.getCertificate,
+	})
+
+	for {
+		conn, err := tlsListener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		go func() {
+			if err := l.handleSNIRoutedConnection(ctx, conn); err != nil && ctx.Err() == nil {
+				log.WithError(err).Debug("Failed to handle SNI-routed local proxy connection.")
+			}
+		}()
+	}
+}
+
+// handleSNIRoutedConnection completes the local TLS handshake, resolves the
+// negotiated SNI to a route, and proxies the connection upstream using that
+// route's LocalProxyConfig.
+func (l *LocalProxy) handleSNIRoutedConnection(ctx context.Context, downstreamConn net.Conn) error {
+	defer downstreamConn.Close()
+
+	tlsConn, ok := downstreamConn.(*tls.Conn)
+	if !ok {
+		return trace.BadParameter("expected a TLS connection")
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return trace.Wrap(err)
+	}
+
+	sni := tlsConn.ConnectionState().ServerName
+	if !strings.HasSuffix(sni, localTeleportDomain) {
+		return trace.NotFound("no local proxy route configured for %q", sni)
+	}
+	name := strings.TrimSuffix(sni, localTeleportDomain)
+	routeCfg, ok := l.cfg.RouteBySNI[name]
+	if !ok {
+		return trace.NotFound("no local proxy route configured for %q", sni)
+	}
+
+	upstreamConn, err := dialUpstreamTLS(ctx, routeCfg)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer upstreamConn.Close()
+
+	errC := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstreamConn, downstreamConn)
+		errC <- err
+	}()
+	go func() {
+		_, err := io.Copy(downstreamConn, upstreamConn)
+		errC <- err
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		if err := <-errC; err != nil && err != io.EOF {
+			errs = append(errs, err)
+		}
+	}
+	return trace.NewAggregate(errs...)
+}
+
+// localCA is a short-lived in-memory certificate authority used to mint one
+// leaf certificate per routed resource, so the client's TLS ClientHello SNI
+// can be trusted locally without round-tripping to the real Teleport CA.
+type localCA struct {
+	cert tls.Certificate
+	x509 *x509.Certificate
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newLocalCA generates a fresh, process-local root CA.
+func newLocalCA() (*localCA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tsh local proxy CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &localCA{
+		cert:  tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		x509:  caCert,
+		certs: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate, minting (and caching)
+// a leaf certificate for the requested SNI on first use.
+func (ca *localCA) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if cert, ok := ca.certs[hello.ServerName]; ok {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hello.ServerName},
+		DNSNames:     []string{hello.ServerName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.x509, &leafKey.PublicKey, ca.cert.PrivateKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Certificate[0]},
+		PrivateKey:  leafKey,
+	}
+	ca.certs[hello.ServerName] = cert
+	return cert, nil
+}
+
+// RouteTable renders a human-readable "name -> connect string" table for a
+// LocalProxy started with RouteBySNI, so the user knows which local hostname
+// reaches which resource.
+func RouteTable(localAddr string, routes map[string]LocalProxyConfig) string {
+	table := ""
+	for name := range routes {
+		table += fmt.Sprintf("  %-32s %s (via %s)\n", RouteBySNIHost(name), localAddr, name)
+	}
+	return table
+}
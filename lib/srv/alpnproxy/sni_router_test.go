@@ -0,0 +1,138 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alpnproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTaggedEchoTLSServer starts a TLS server that, for every connection,
+// first writes tag then echoes back anything it reads.
+func newTaggedEchoTLSServer(t *testing.T, tag string) string {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedTestCert(t)},
+		ClientAuth:   tls.NoClientCert,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte(tag)); err != nil {
+					return
+				}
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestLocalProxySNIRouter(t *testing.T) {
+	t.Parallel()
+
+	const numResources = 6
+	routes := make(map[string]LocalProxyConfig, numResources)
+	for i := 0; i < numResources; i++ {
+		name := fmt.Sprintf("resource-%d", i)
+		routes[name] = LocalProxyConfig{
+			RemoteProxyAddr:    newTaggedEchoTLSServer(t, name),
+			Protocol:           "teleport-postgres",
+			InsecureSkipVerify: true,
+		}
+	}
+
+	lp, err := NewLocalProxy(LocalProxyConfig{RouteBySNI: routes})
+	require.NoError(t, err)
+	defer lp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lp.Start(ctx)
+
+	var wg sync.WaitGroup
+	for name := range routes {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertRoutedTo(t, lp.GetAddr(), name)
+		}()
+	}
+	wg.Wait()
+}
+
+func assertRoutedTo(t *testing.T, localAddr, name string) {
+	t.Helper()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", localAddr, &tls.Config{
+		ServerName:         RouteBySNIHost(name),
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, len(name))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, name, string(buf))
+}
+
+func TestLocalProxySNIRouterUnknownRoute(t *testing.T) {
+	t.Parallel()
+
+	lp, err := NewLocalProxy(LocalProxyConfig{RouteBySNI: map[string]LocalProxyConfig{
+		"known": {RemoteProxyAddr: newTaggedEchoTLSServer(t, "known"), Protocol: "teleport-postgres", InsecureSkipVerify: true},
+	}})
+	require.NoError(t, err)
+	defer lp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lp.Start(ctx)
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", lp.GetAddr(), &tls.Config{
+		ServerName:         RouteBySNIHost("unknown"),
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	require.Error(t, err)
+}
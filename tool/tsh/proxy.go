@@ -22,8 +22,10 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
@@ -82,13 +84,21 @@ func sshProxyWithTLSRouting(cf *CLIConf, tc *libclient.TeleportClient, targetHos
 		return trace.Wrap(err)
 	}
 
-	pool, err := tc.LocalAgent().ClientCertPool(tc.SiteName)
+	tlsConfig := &tls.Config{}
+
+	proxyDialer, err := newProxyDialer(cf.ProxyURL, tc.WebProxyAddr)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	tlsConfig := &tls.Config{
-		RootCAs: pool,
+
+	keysDir := profile.FullProfilePath(tc.Config.KeysDir)
+	reloader, err := alpnproxy.NewCertReloader(keysDir, nil, func() (*x509.CertPool, error) {
+		return tc.LocalAgent().ClientCertPool(tc.SiteName)
+	})
+	if err != nil {
+		return trace.Wrap(err)
 	}
+	defer reloader.Close()
 
 	lp, err := alpnproxy.NewLocalProxy(alpnproxy.LocalProxyConfig{
 		RemoteProxyAddr:    tc.WebProxyAddr,
@@ -101,6 +111,8 @@ func sshProxyWithTLSRouting(cf *CLIConf, tc *libclient.TeleportClient, targetHos
 		SSHHostKeyCallback: tc.HostKeyCallback,
 		SSHTrustedCluster:  cf.SiteName,
 		ClientTLSConfig:    tlsConfig,
+		ProxyDialer:        proxyDialer,
+		GetRootCAs:         reloader.GetRootCAs,
 	})
 	if err != nil {
 		return trace.Wrap(err)
@@ -142,6 +154,10 @@ func sshProxy(cf *CLIConf, tc *libclient.TeleportClient, targetHost, targetPort
 }
 
 func onProxyCommandDB(cf *CLIConf) error {
+	if cf.LocalProxyAll {
+		return trace.Wrap(onProxyCommandDBAll(cf))
+	}
+
 	client, err := makeClient(cf, false)
 	if err != nil {
 		return trace.Wrap(err)
@@ -175,6 +191,7 @@ func onProxyCommandDB(cf *CLIConf) error {
 		insecure:  cf.InsecureSkipVerify,
 		certFile:  cf.LocalProxyCertFile,
 		keyFile:   cf.LocalProxyKeyFile,
+		proxyURL:  cf.ProxyURL,
 	})
 	if err != nil {
 		return trace.Wrap(err)
@@ -207,6 +224,98 @@ func onProxyCommandDB(cf *CLIConf) error {
 	return nil
 }
 
+// onProxyCommandDBAll implements `tsh proxy db --all`: it opens a single
+// local TLS listener and demultiplexes incoming connections to every
+// database the user is currently logged in to based on the client's TLS SNI.
+func onProxyCommandDBAll(cf *CLIConf) error {
+	tc, err := makeClient(cf, false)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	profile, err := libclient.StatusCurrent(cf.HomePath, cf.Proxy)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(profile.Databases) == 0 {
+		return trace.BadParameter("not logged in to any databases, please use 'tsh db login' first")
+	}
+
+	address, err := utils.ParseAddr(tc.WebProxyAddr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	proxyDialer, err := newProxyDialer(cf.ProxyURL, tc.WebProxyAddr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	routes := make(map[string]alpnproxy.LocalProxyConfig, len(profile.Databases))
+	for _, db := range profile.Databases {
+		alpnProtocol, err := alpncommon.ToALPNProtocol(db.Protocol)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cert, err := loadDatabaseCertificate(tc, db.ServiceName)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		routes[db.ServiceName] = alpnproxy.LocalProxyConfig{
+			RemoteProxyAddr:    tc.WebProxyAddr,
+			Protocol:           alpnProtocol,
+			InsecureSkipVerify: cf.InsecureSkipVerify,
+			SNI:                address.Host(),
+			Certs:              []tls.Certificate{cert},
+			ProxyDialer:        proxyDialer,
+		}
+	}
+
+	addr := "localhost:0"
+	if cf.LocalProxyPort != "" {
+		addr = fmt.Sprintf("127.0.0.1:%s", cf.LocalProxyPort)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	lp, err := alpnproxy.NewLocalProxy(alpnproxy.LocalProxyConfig{
+		Listener:      listener,
+		ParentContext: cf.Context,
+		RouteBySNI:    routes,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer lp.Close()
+
+	fmt.Printf("Started DB proxy on %s, routing:\n%s", listener.Addr().String(), alpnproxy.RouteTable(listener.Addr().String(), routes))
+
+	go func() {
+		<-cf.Context.Done()
+		lp.Close()
+	}()
+	return trace.Wrap(lp.Start(cf.Context))
+}
+
+// loadDatabaseCertificate loads the client certificate used to authenticate
+// to the given database, mirroring loadAppCertificate for apps.
+func loadDatabaseCertificate(tc *libclient.TeleportClient, dbServiceName string) (tls.Certificate, error) {
+	key, err := tc.LocalAgent().GetKey(tc.SiteName, client.WithDBCerts{})
+	if err != nil {
+		return tls.Certificate{}, trace.Wrap(err)
+	}
+	cc, ok := key.DBTLSCerts[dbServiceName]
+	if !ok {
+		return tls.Certificate{}, trace.NotFound("please login into the database first. 'tsh db login %s'", dbServiceName)
+	}
+	cert, err := tls.X509KeyPair(cc, key.Priv)
+	if err != nil {
+		return tls.Certificate{}, trace.Wrap(err)
+	}
+	return cert, nil
+}
+
 type localProxyOpts struct {
 	proxyAddr string
 	listener  net.Listener
@@ -214,6 +323,9 @@ type localProxyOpts struct {
 	insecure  bool
 	certFile  string
 	keyFile   string
+	// proxyURL is the upstream HTTP CONNECT or SOCKS5 proxy (--proxy-url)
+	// to dial the Teleport web proxy through, if any.
+	proxyURL string
 }
 
 func mkLocalProxy(ctx context.Context, opts localProxyOpts) (*alpnproxy.LocalProxy, error) {
@@ -225,18 +337,43 @@ func mkLocalProxy(ctx context.Context, opts localProxyOpts) (*alpnproxy.LocalPro
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	certs, err := mkLocalProxyCerts(opts.certFile, opts.keyFile)
+	// mkLocalProxyCerts only validates that --cert-file/--key-file were
+	// given together and load cleanly; the loaded pair itself is discarded
+	// once a reloader takes over, since LocalProxyConfig.GetClientCertificate
+	// takes priority over the static Certs field.
+	if _, err := mkLocalProxyCerts(opts.certFile, opts.keyFile); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	proxyDialer, err := newProxyDialer(opts.proxyURL, opts.proxyAddr)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+
+	var getClientCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	if opts.certFile != "" && opts.keyFile != "" {
+		reloader, err := alpnproxy.NewCertReloader(filepath.Dir(opts.certFile), func() (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+			return &cert, trace.Wrap(err)
+		}, nil)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		getClientCert = reloader.GetClientCertificate
+		go func() {
+			<-ctx.Done()
+			reloader.Close()
+		}()
+	}
+
 	lp, err := alpnproxy.NewLocalProxy(alpnproxy.LocalProxyConfig{
-		InsecureSkipVerify: opts.insecure,
-		RemoteProxyAddr:    opts.proxyAddr,
-		Protocol:           alpnProtocol,
-		Listener:           opts.listener,
-		ParentContext:      ctx,
-		SNI:                address.Host(),
-		Certs:              certs,
+		InsecureSkipVerify:   opts.insecure,
+		RemoteProxyAddr:      opts.proxyAddr,
+		Protocol:             alpnProtocol,
+		Listener:             opts.listener,
+		ParentContext:        ctx,
+		SNI:                  address.Host(),
+		ProxyDialer:          proxyDialer,
+		GetClientCertificate: getClientCert,
 	})
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -259,12 +396,11 @@ func mkLocalProxyCerts(certFile, keyFile string) ([]tls.Certificate, error) {
 }
 
 func onProxyCommandApp(cf *CLIConf) error {
-	tc, err := makeClient(cf, false)
-	if err != nil {
-		return trace.Wrap(err)
+	if cf.LocalProxyAll {
+		return trace.Wrap(onProxyCommandAppAll(cf))
 	}
 
-	appCerts, err := loadAppCertificate(tc, cf.AppName)
+	tc, err := makeClient(cf, false)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -284,14 +420,39 @@ func onProxyCommandApp(cf *CLIConf) error {
 		return trace.Wrap(err)
 	}
 
+	proxyDialer, err := newProxyDialer(cf.ProxyURL, tc.WebProxyAddr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	mitm, err := maybeSetupInspectMITM(cf, tc)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if mitm != nil {
+		defer mitm.Logger.Close()
+	}
+
+	keysDir := profile.FullProfilePath(tc.Config.KeysDir)
+	reloader, err := alpnproxy.NewCertReloader(keysDir, func() (*tls.Certificate, error) {
+		cert, err := loadAppCertificate(tc, cf.AppName)
+		return &cert, trace.Wrap(err)
+	}, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer reloader.Close()
+
 	lp, err := alpnproxy.NewLocalProxy(alpnproxy.LocalProxyConfig{
-		Listener:           listener,
-		RemoteProxyAddr:    tc.WebProxyAddr,
-		Protocol:           alpncommon.ProtocolHTTP,
-		InsecureSkipVerify: cf.InsecureSkipVerify,
-		ParentContext:      cf.Context,
-		SNI:                address.Host(),
-		Certs:              []tls.Certificate{appCerts},
+		Listener:             listener,
+		RemoteProxyAddr:      tc.WebProxyAddr,
+		Protocol:             alpncommon.ProtocolHTTP,
+		InsecureSkipVerify:   cf.InsecureSkipVerify,
+		ParentContext:        cf.Context,
+		SNI:                  address.Host(),
+		ProxyDialer:          proxyDialer,
+		MITM:                 mitm,
+		GetClientCertificate: reloader.GetClientCertificate,
 	})
 	if err != nil {
 		if cerr := listener.Close(); cerr != nil {
@@ -315,6 +476,130 @@ func onProxyCommandApp(cf *CLIConf) error {
 	return nil
 }
 
+// maybeSetupInspectMITM builds the alpnproxy.MITMConfig used by --inspect
+// mode, or returns nil if the flag wasn't passed. On first use it generates
+// a local root CA under ~/.tsh/keys/<proxy>/mitm/ and prints install
+// instructions for it.
+func maybeSetupInspectMITM(cf *CLIConf, tc *libclient.TeleportClient) (*alpnproxy.MITMConfig, error) {
+	if !cf.Inspect {
+		return nil, nil
+	}
+
+	keysDir := profile.FullProfilePath(tc.Config.KeysDir)
+	mitmDir := filepath.Join(keysDir, "keys", tc.WebProxyHost(), "mitm")
+	caCertPath := filepath.Join(mitmDir, "ca.crt")
+	caKeyPath := filepath.Join(mitmDir, "ca.key")
+
+	_, statErr := os.Stat(caCertPath)
+	isFirstUse := statErr != nil
+
+	certConfig, err := alpnproxy.NewMITMCertConfig(caCertPath, caKeyPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if isFirstUse {
+		fmt.Printf(inspectCATpl, caCertPath)
+	}
+
+	logger := alpnproxy.NewRequestLogger(alpnproxy.RequestLoggerConfig{
+		Out:         os.Stderr,
+		HARPath:     cf.InspectFile,
+		NoBody:      cf.InspectNoBody,
+		MaxBodySize: inspectMaxBodySize,
+	})
+
+	return &alpnproxy.MITMConfig{CertConfig: certConfig, Logger: logger}, nil
+}
+
+// inspectMaxBodySize caps how much of a request/response body --inspect
+// captures, to keep memory use bounded for large uploads/downloads.
+const inspectMaxBodySize = 1 << 20 // 1MiB
+
+// inspectCATpl is printed the first time --inspect generates a local MITM CA.
+const inspectCATpl = `Generated a local certificate authority for 'tsh proxy app --inspect' at:
+  %s
+
+To see decrypted traffic without certificate warnings, trust this CA in your
+browser or system trust store, e.g. on macOS:
+  sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain <path above>
+or on Linux (update-ca-certificates):
+  sudo cp <path above> /usr/local/share/ca-certificates/tsh-inspect.crt && sudo update-ca-certificates
+
+`
+
+// onProxyCommandAppAll implements `tsh proxy app --all`: it opens a single
+// local TLS listener and demultiplexes incoming connections to every
+// application the user is currently logged in to based on the client's TLS SNI.
+func onProxyCommandAppAll(cf *CLIConf) error {
+	tc, err := makeClient(cf, false)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	key, err := tc.LocalAgent().GetKey(tc.SiteName, client.WithAppCerts{})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(key.AppTLSCerts) == 0 {
+		return trace.BadParameter("not logged in to any applications, please use 'tsh app login' first")
+	}
+
+	address, err := utils.ParseAddr(tc.WebProxyAddr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	proxyDialer, err := newProxyDialer(cf.ProxyURL, tc.WebProxyAddr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	routes := make(map[string]alpnproxy.LocalProxyConfig, len(key.AppTLSCerts))
+	for appName := range key.AppTLSCerts {
+		cert, err := loadAppCertificate(tc, appName)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		routes[appName] = alpnproxy.LocalProxyConfig{
+			RemoteProxyAddr:    tc.WebProxyAddr,
+			Protocol:           alpncommon.ProtocolHTTP,
+			InsecureSkipVerify: cf.InsecureSkipVerify,
+			SNI:                address.Host(),
+			Certs:              []tls.Certificate{cert},
+			ProxyDialer:        proxyDialer,
+		}
+	}
+
+	addr := "localhost:0"
+	if cf.LocalProxyPort != "" {
+		addr = fmt.Sprintf("127.0.0.1:%s", cf.LocalProxyPort)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	lp, err := alpnproxy.NewLocalProxy(alpnproxy.LocalProxyConfig{
+		Listener:      listener,
+		ParentContext: cf.Context,
+		RouteBySNI:    routes,
+	})
+	if err != nil {
+		if cerr := listener.Close(); cerr != nil {
+			return trace.NewAggregate(err, cerr)
+		}
+		return trace.Wrap(err)
+	}
+	defer lp.Close()
+
+	fmt.Printf("Started app proxy on %s, routing:\n%s", listener.Addr().String(), alpnproxy.RouteTable(listener.Addr().String(), routes))
+
+	go func() {
+		<-cf.Context.Done()
+		lp.Close()
+	}()
+	return trace.Wrap(lp.Start(cf.Context))
+}
+
 func loadAppCertificate(tc *client.TeleportClient, appName string) (tls.Certificate, error) {
 	key, err := tc.LocalAgent().GetKey(tc.SiteName, client.WithAppCerts{})
 	if err != nil {
@@ -343,6 +628,22 @@ func loadAppCertificate(tc *client.TeleportClient, appName string) (tls.Certific
 	return cert, nil
 }
 
+// newProxyDialer builds the alpnproxy.ContextDialer used to reach webProxyAddr.
+// If proxyURL is non-empty it takes precedence, otherwise the standard
+// HTTPS_PROXY/ALL_PROXY/NO_PROXY environment variables are consulted.
+func newProxyDialer(proxyURL, webProxyAddr string) (alpnproxy.ContextDialer, error) {
+	if proxyURL == "" {
+		dialer, err := alpnproxy.NewProxyDialerFromEnvironment(webProxyAddr)
+		return dialer, trace.Wrap(err)
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, trace.BadParameter("invalid --proxy-url %q: %v", proxyURL, err)
+	}
+	dialer, err := alpnproxy.NewProxyDialer(u)
+	return dialer, trace.Wrap(err)
+}
+
 // dbProxyTpl is the message that gets printed to a user when a database proxy is started.
 var dbProxyTpl = template.Must(template.New("").Parse(`Started DB proxy on {{.address}}
 
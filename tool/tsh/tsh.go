@@ -0,0 +1,99 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// CLIConf holds the flags and arguments recognized by tsh's `proxy`
+// subcommands. tsh's full CLIConf carries many more fields for its other
+// commands; this is the subset tool/tsh/proxy.go reads.
+type CLIConf struct {
+	// Context is canceled when tsh should shut down any local proxies it started.
+	Context context.Context
+	// HomePath is the local tsh profile directory (~/.tsh by default).
+	HomePath string
+	// Proxy is the --proxy address of the Teleport web proxy.
+	Proxy string
+	// SiteName is the name of the cluster to operate against.
+	SiteName string
+	// AppName is the application to proxy, for `tsh proxy app`.
+	AppName string
+	// InsecureSkipVerify turns off verification of the web proxy's TLS certificate.
+	InsecureSkipVerify bool
+
+	// LocalProxyPort is the source port the local proxy listens on (--port).
+	LocalProxyPort string
+	// LocalProxyCertFile is the client certificate used to authenticate the
+	// local proxy to the web proxy (--cert-file).
+	LocalProxyCertFile string
+	// LocalProxyKeyFile is the key paired with LocalProxyCertFile (--key-file).
+	LocalProxyKeyFile string
+	// LocalProxyAll runs a single SNI-routed local proxy across every
+	// resource the user is logged in to, instead of one resource at a time
+	// (--all).
+	LocalProxyAll bool
+
+	// ProxyURL is the upstream HTTP CONNECT or SOCKS5 proxy to dial the
+	// Teleport web proxy through (--proxy-url). When empty, the standard
+	// HTTPS_PROXY/ALL_PROXY/NO_PROXY environment variables are consulted.
+	ProxyURL string
+
+	// Inspect enables MITM HTTP inspection of `tsh proxy app` traffic (--inspect).
+	Inspect bool
+	// InspectFile, if set, writes captured HTTP traffic as a HAR document to
+	// this path instead of logging a line per exchange to stderr
+	// (--inspect-file).
+	InspectFile string
+	// InspectNoBody omits request/response bodies from --inspect output (--no-body).
+	InspectNoBody bool
+}
+
+// initProxyCommand registers the `tsh proxy` subcommands and their flags on
+// proxy, wiring each to the on* handler in proxy.go that implements it.
+func initProxyCommand(proxy *kingpin.CmdClause, cf *CLIConf) {
+	ssh := proxy.Command("ssh", "Start local TLS ALPN SNI proxy for ssh connections.")
+	ssh.Flag("proxy-url", "Upstream HTTP CONNECT or SOCKS5 proxy to dial the Teleport proxy through.").StringVar(&cf.ProxyURL)
+	ssh.Action(func(*kingpin.ParseContext) error {
+		return onProxyCommandSSH(cf)
+	})
+
+	db := proxy.Command("db", "Start local TLS ALPN SNI proxy for database connections.")
+	db.Flag("port", "Specifies the source port used by the proxy db listener.").StringVar(&cf.LocalProxyPort)
+	db.Flag("cert-file", "Certificate file for proxy client TLS configuration.").StringVar(&cf.LocalProxyCertFile)
+	db.Flag("key-file", "Key file for proxy client TLS configuration.").StringVar(&cf.LocalProxyKeyFile)
+	db.Flag("proxy-url", "Upstream HTTP CONNECT or SOCKS5 proxy to dial the Teleport proxy through.").StringVar(&cf.ProxyURL)
+	db.Flag("all", "Start a single local proxy routing to every database you are logged in to, selected by TLS SNI.").BoolVar(&cf.LocalProxyAll)
+	db.Action(func(*kingpin.ParseContext) error {
+		return onProxyCommandDB(cf)
+	})
+
+	app := proxy.Command("app", "Start local TLS ALPN SNI proxy for application connections.")
+	app.Arg("app", "Name of the application to start local proxy for.").StringVar(&cf.AppName)
+	app.Flag("port", "Specifies the source port used by the proxy app listener.").StringVar(&cf.LocalProxyPort)
+	app.Flag("proxy-url", "Upstream HTTP CONNECT or SOCKS5 proxy to dial the Teleport proxy through.").StringVar(&cf.ProxyURL)
+	app.Flag("all", "Start a single local proxy routing to every application you are logged in to, selected by TLS SNI.").BoolVar(&cf.LocalProxyAll)
+	app.Flag("inspect", "Terminate TLS locally and log HTTP requests/responses seen through the proxy.").BoolVar(&cf.Inspect)
+	app.Flag("inspect-file", "With --inspect, write captured traffic as a HAR document to this path instead of logging to stderr.").StringVar(&cf.InspectFile)
+	app.Flag("no-body", "With --inspect, omit request/response bodies from captured traffic.").BoolVar(&cf.InspectNoBody)
+	app.Action(func(*kingpin.ParseContext) error {
+		return onProxyCommandApp(cf)
+	})
+}